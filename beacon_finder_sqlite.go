@@ -0,0 +1,17 @@
+//go:build sqlite
+
+package main
+
+/*	beacon_finder_sqlite.go
+ *	github.com/chadpierce/beacon_analysis
+ *
+ *	Registers the pure Go (no cgo) sqlite driver used by the -db option and sqlite:// input.
+ *	It is kept out of the default build so beacon_finder.go stays free of third party dependencies.
+ *	The driver version is pinned in go.mod:
+ *
+ *	go build -tags sqlite -o beacon_finder beacon_finder.go beacon_finder_sqlite.go
+ */
+
+import (
+	_ "modernc.org/sqlite"
+)
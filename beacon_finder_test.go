@@ -0,0 +1,876 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// the INFO lines every run logs are only shown with -v
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+var (
+	defaultsOnce sync.Once
+	defaults     Options
+)
+
+// the options a run gets with no flags, read from getOptions so they follow the flag defaults
+func defaultOptions() Options {
+	defaultsOnce.Do(func() {
+		args := os.Args
+		os.Args = []string{"beacon_finder", "-i", "-"}
+		defaults = getOptions()
+		os.Args = args
+	})
+	return defaults
+}
+
+// options for csv rows of time,source,destination,bytes sent,bytes received
+func testOptions() Options {
+	opts := defaultOptions()
+	opts.InputFiles = nil
+	opts.Comma = ","
+	opts.TimeFormat = "2006-01-02-15:04:05"
+	opts.ColumnTime = 0
+	opts.ColumnTimeOfDay = -1
+	opts.ColumnSource = 1
+	opts.ColumnDest = 2
+	opts.ColumnByteSent = 3
+	opts.ColumnByteRecv = 4
+	opts.ColumnPort = -1
+	opts.ColumnMethod = -1
+	opts.ColumnJA3 = -1
+	opts.ParseWorkers = 1
+	return opts
+}
+
+// runs read in the background so a decoder stuck in a loop fails the test instead of hanging it
+func withTimeout(t *testing.T, read func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		read()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("read did not return")
+	}
+}
+
+func TestNetFlowV9ZeroLengthTemplate(t *testing.T) {
+	// a v9 packet with a template whose only field is 0 bytes long, followed by an empty data flowset for it
+	packet := []byte{
+		0x00, 0x09, 0x00, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, // header, 2 flowsets
+		0x00, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x01, 0x00, 0x08, 0x00, 0x00, // template 256, IPV4_SRC_ADDR length 0
+		0x01, 0x00, 0x00, 0x04, // data flowset for template 256
+	}
+	withTimeout(t, func() {
+		var stats ReadStats
+		if records := readNetFlowRecords(bytes.NewReader(packet), &stats); len(records) != 0 {
+			t.Errorf("got %d records, want 0", len(records))
+		}
+	})
+}
+
+func TestIPFIXZeroLengthTemplate(t *testing.T) {
+	// an ipfix message with a template whose only field is 0 bytes long, followed by an empty data set for it
+	message := []byte{
+		0x00, 0x0a, 0x00, 0x20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, // header, 32 bytes
+		0x00, 0x02, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x01, 0x00, 0x08, 0x00, 0x00, // template 256, sourceIPv4Address length 0
+		0x01, 0x00, 0x00, 0x04, // data set for template 256
+	}
+	withTimeout(t, func() {
+		var stats ReadStats
+		if records := readNetFlowRecords(bytes.NewReader(message), &stats); len(records) != 0 {
+			t.Errorf("got %d records, want 0", len(records))
+		}
+	})
+}
+
+func TestParseLiveMessagesSkipsMalformedRows(t *testing.T) {
+	opts := testOptions()
+	opts.ColumnPort = 5
+	messages := [][]byte{
+		[]byte("2023-03-02-00:00:00,10.0.0.5,example.com,300,200,443"),
+		[]byte("yesterday,10.0.0.5,example.com,300,200,443"),
+		[]byte("2023-03-02-00:01:00,10.0.0.5,example.com,300,200,https"),
+		[]byte("2023-03-02-00:02:00,10.0.0.5,example.com,lots,200,443"),
+		[]byte("2023-03-02-00:03:00,10.0.0.5,example.com,300,200,443"),
+	}
+	batch := parseLiveMessages(messages, &opts)
+	if len(batch.records) != 2 {
+		t.Errorf("got %d records, want 2", len(batch.records))
+	}
+	if batch.stats.MalformedRows != 3 || batch.stats.SkippedRows != 3 {
+		t.Errorf("got %d malformed and %d skipped rows, want 3 and 3", batch.stats.MalformedRows, batch.stats.SkippedRows)
+	}
+}
+
+func TestParseLiveMessagesDetectsTimeFormatOnce(t *testing.T) {
+	opts := testOptions()
+	opts.TimeFormat = "auto"
+	garbage := [][]byte{[]byte("notatime,10.0.0.5,example.com,300,200")}
+	batch := parseLiveMessages(garbage, &opts)
+	if len(batch.records) != 0 || batch.stats.MalformedRows != 1 {
+		t.Errorf("got %d records and %d malformed rows, want 0 and 1", len(batch.records), batch.stats.MalformedRows)
+	}
+	if opts.TimeFormat != "auto" {
+		t.Errorf("got -T %q after an undetectable batch, want auto", opts.TimeFormat)
+	}
+
+	batch = parseLiveMessages([][]byte{[]byte("1700000000,10.0.0.5,example.com,300,200")}, &opts)
+	if len(batch.records) != 1 || opts.TimeFormat != "epoch" {
+		t.Fatalf("got %d records with -T %q, want 1 with epoch", len(batch.records), opts.TimeFormat)
+	}
+	// later batches keep the layout instead of detecting again
+	batch = parseLiveMessages([][]byte{[]byte("2023-03-02-00:00:00,10.0.0.5,example.com,300,200")}, &opts)
+	if len(batch.records) != 0 || batch.stats.MalformedRows != 1 || opts.TimeFormat != "epoch" {
+		t.Errorf("got %d records and %d malformed rows with -T %q, want 0 and 1 with epoch", len(batch.records), batch.stats.MalformedRows, opts.TimeFormat)
+	}
+}
+
+func TestParseLiveMessagesDetectsDelimiterOnce(t *testing.T) {
+	opts := testOptions()
+	opts.Comma = "auto"
+	batch := parseLiveMessages([][]byte{[]byte("2023-03-02-00:00:00;10.0.0.5;example.com;300;200")}, &opts)
+	if len(batch.records) != 1 || opts.Comma != ";" {
+		t.Fatalf("got %d records with -d %q, want 1 with ;", len(batch.records), opts.Comma)
+	}
+	// a later batch that would sniff as tab separated is still split on semicolons
+	batch = parseLiveMessages([][]byte{[]byte("2023-03-02-00:01:00;10.0.0.5;a\tb\tc\td\te\tf;300;200")}, &opts)
+	if len(batch.records) != 1 || batch.records[0].Dst != "a\tb\tc\td\te\tf" || opts.Comma != ";" {
+		t.Errorf("got %d records with -d %q, want 1 with ;", len(batch.records), opts.Comma)
+	}
+}
+
+func TestListenBackoff(t *testing.T) {
+	var delays []time.Duration
+	var delay time.Duration
+	for i := 0; i < 10; i++ {
+		delay = listenBackoff(delay, errors.New("accept: too many open files"))
+		delays = append(delays, delay)
+	}
+	if delays[0] != 5*time.Millisecond || delays[1] != 10*time.Millisecond || delays[9] != time.Second {
+		t.Errorf("got delays %v, want 5ms doubling up to 1s", delays)
+	}
+	if delay := listenBackoff(time.Second, fmt.Errorf("read: %w", net.ErrClosed)); delay != 0 {
+		t.Errorf("got %s after the listener closed, want 0", delay)
+	}
+}
+
+func TestNormalizeDest(t *testing.T) {
+	tests := []struct {
+		name      string
+		dst       string
+		splitPort bool
+		wantDst   string
+		wantPort  int
+		wantMoved bool
+	}{
+		{"plain", "evil.com", true, "evil.com", 0, false},
+		{"trailing dot", "evil.com.", true, "evil.com", 0, false},
+		{"port split", "evil.com:443", true, "evil.com", 443, true},
+		{"port dropped", "evil.com:443", false, "evil.com", 0, false},
+		{"url", "https://evil.com/beacon", true, "evil.com", 0, false},
+		{"url with port", "https://evil.com:8443/beacon", true, "evil.com", 8443, true},
+		{"query", "evil.com?id=1", true, "evil.com", 0, false},
+		{"ipv6 with port", "[2001:db8::1]:443", true, "2001:db8::1", 443, true},
+		{"ipv6", "2001:db8::1", true, "2001:db8::1", 0, false},
+		{"not a port", "evil.com:https", true, "evil.com:https", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record := Record{Dst: test.dst}
+			moved := record.NormalizeDest(test.splitPort)
+			if record.Dst != test.wantDst || record.Port != test.wantPort || moved != test.wantMoved {
+				t.Errorf("got %q port %d moved %v, want %q port %d moved %v",
+					record.Dst, record.Port, moved, test.wantDst, test.wantPort, test.wantMoved)
+			}
+		})
+	}
+}
+
+func TestGroupInputRecordsKeepsSplitPort(t *testing.T) {
+	opts := testOptions()
+	opts.Normalize = true
+	start := time.Date(2023, 3, 2, 0, 0, 0, 0, time.UTC)
+	records := []Record{
+		{Timestamp: start, Src: "10.0.0.5", Dst: "evil.com:443"},
+		{Timestamp: start.Add(time.Minute), Src: "10.0.0.5", Dst: "evil.com:443"},
+		{Timestamp: start.Add(2 * time.Minute), Src: "10.0.0.5", Dst: "evil.com:8443"},
+	}
+	groups, isPort := groupInputRecords(records, opts, false, false)
+	if !isPort {
+		t.Fatal("got isPort false after splitting ports off the destinations")
+	}
+	if len(groups) != 2 {
+		t.Fatalf("got %d groups, want one per port", len(groups))
+	}
+	for _, group := range groups {
+		if group.Dst != "evil.com" || (group.Port != 443 && group.Port != 8443) {
+			t.Errorf("got group %s port %d", group.Dst, group.Port)
+		}
+	}
+}
+
+// scores the groups of a dataset written by generateDataset, by source
+func scoreGeneratedDataset(t *testing.T, opts Options, seed int64) map[string]ScoredRecord {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), "generated.csv")
+	generateDataset(fileName, seed)
+	opts.InputFiles = []string{fileName}
+	groupedRecords, _, _, _ := readGroupedRecords(opts)
+	scores := make(map[string]ScoredRecord)
+	for _, groupedRecord := range groupedRecords {
+		scored := scoreGroupedRecord(groupedRecord, opts)
+		if best, ok := scores[scored.Src]; !ok || scored.Score > best.Score {
+			scores[scored.Src] = scored
+		}
+	}
+	return scores
+}
+
+func TestGeneratedDatasetRanking(t *testing.T) {
+	scores := scoreGeneratedDataset(t, defaultOptions(), 1)
+	clean, jittered := scores["beacon-clean"], scores["beacon-jitter"]
+	random := 0.0
+	for src, scored := range scores {
+		if strings.HasPrefix(src, "user") && scored.Score > random {
+			random = scored.Score
+		}
+	}
+	if !(clean.Score > jittered.Score && jittered.Score > random) {
+		t.Errorf("got clean %.3f, jittered %.3f, best random %.3f, want them in that order", clean.Score, jittered.Score, random)
+	}
+}
+
+// a group of conns connections, the deltas and sent sizes given in turn
+func testGroup(conns int, deltas []float64, sizes []int) GroupedRecord {
+	group := GroupedRecord{Src: "10.0.0.5", Dst: "evil.com"}
+	timestamp := time.Date(2023, 3, 2, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < conns; i++ {
+		if i > 0 {
+			timestamp = timestamp.Add(time.Duration(deltas[i%len(deltas)] * float64(time.Second)))
+		}
+		group.Times = append(group.Times, timestamp)
+		group.SentSizes = append(group.SentSizes, sizes[i%len(sizes)])
+		group.ReceivedSizes = append(group.ReceivedSizes, 100)
+	}
+	return group
+}
+
+// fails on any float field of scored that is NaN or infinite
+func checkFinite(t *testing.T, scored ScoredRecord) {
+	t.Helper()
+	value := reflect.ValueOf(scored)
+	for i := 0; i < value.NumField(); i++ {
+		if field := value.Field(i); field.Kind() == reflect.Float64 {
+			if f := field.Float(); math.IsNaN(f) || math.IsInf(f, 0) {
+				t.Errorf("%s is %v", value.Type().Field(i).Name, f)
+			}
+		}
+	}
+}
+
+func TestBowleySkew(t *testing.T) {
+	tests := []struct {
+		name           string
+		low, mid, high float64
+		want           float64
+	}{
+		{"constant", 60, 60, 60, 0},
+		{"low equals mid", 60, 60, 120, 0},
+		{"mid equals high", 60, 120, 120, 0},
+		{"symmetric", 30, 60, 90, 0},
+		{"right skewed", 30, 40, 90, 0.6666666666666666},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := bowleySkew(test.low, test.mid, test.high); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestScoreConstantDeltasAndSizes(t *testing.T) {
+	opts := defaultOptions()
+	tests := []struct {
+		name   string
+		deltas []float64
+		sizes  []int
+	}{
+		{"constant deltas and sizes", []float64{60}, []int{256}},
+		{"constant deltas", []float64{60}, []int{256, 300, 512, 280}},
+		{"constant sizes", []float64{50, 60, 70, 65}, []int{256}},
+		{"zero sizes", []float64{60}, []int{0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scored := scoreGroupedRecord(testGroup(100, test.deltas, test.sizes), opts)
+			checkFinite(t, scored)
+			if scored.Score <= 0 || scored.Score > 1 {
+				t.Errorf("got score %v, want it in (0, 1]", scored.Score)
+			}
+		})
+	}
+}
+
+func TestCheckWeights(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(opts *Options)
+		wantErr bool
+	}{
+		{"defaults", func(opts *Options) {}, false},
+		{"time and data zeroed", func(opts *Options) { opts.WeightTime, opts.WeightData = 0, 0 }, true},
+		{"time zeroed without bytes", func(opts *Options) { opts.WeightTime, opts.NoBytes = 0, true }, true},
+		{"interval only", func(opts *Options) { opts.WeightTime, opts.WeightData, opts.Interval = 0, 0, time.Minute }, false},
+		{"time parts zeroed", func(opts *Options) { opts.WeightTSSkew, opts.WeightTSMadm, opts.WeightTSConn = 0, 0, 0 }, true},
+		{"data parts zeroed", func(opts *Options) {
+			opts.WeightDSSkew, opts.WeightDSMadm, opts.WeightDSSmall, opts.WeightDSRatio = 0, 0, 0, 0
+		}, true},
+		{"data parts zeroed without bytes", func(opts *Options) {
+			opts.WeightDSSkew, opts.WeightDSMadm, opts.WeightDSSmall, opts.WeightDSRatio, opts.NoBytes = 0, 0, 0, 0, true
+		}, false},
+		{"negative", func(opts *Options) { opts.WeightTSConn = -1 }, true},
+		{"nan", func(opts *Options) { opts.WeightDSSkew = math.NaN() }, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := defaultOptions()
+			test.set(&opts)
+			err := checkWeights(opts)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if err == nil {
+				checkFinite(t, scoreGroupedRecord(testGroup(100, []float64{60}, []int{256}), opts))
+			}
+		})
+	}
+}
+
+func TestTopScoredRecordsMatchesSort(t *testing.T) {
+	// few distinct scores, so most records tie with others
+	rng := rand.New(rand.NewSource(1))
+	var records []ScoredRecord
+	for i := 0; i < 500; i++ {
+		records = append(records, ScoredRecord{
+			Src:   fmt.Sprintf("10.0.0.%d", rng.Intn(20)),
+			Dst:   fmt.Sprintf("site%d.example.com", i),
+			Score: float64(rng.Intn(10)) / 10,
+		})
+	}
+	sorted := append([]ScoredRecord(nil), records...)
+	sort.Slice(sorted, func(i, j int) bool { return scoredBefore(sorted[i], sorted[j]) })
+
+	for _, n := range []int{1, 10, 75, 500, 600} {
+		rng.Shuffle(len(records), func(i, j int) { records[i], records[j] = records[j], records[i] })
+		scores := make(chan ScoredRecord, len(records))
+		for _, record := range records {
+			scores <- record
+		}
+		close(scores)
+		top, total := topScoredRecords(scores, n)
+		want := sorted
+		if n < len(want) {
+			want = want[:n]
+		}
+		if total != len(records) || !reflect.DeepEqual(top, want) {
+			t.Errorf("-n %d: top records differ from the sorted records", n)
+		}
+	}
+}
+
+func TestRelativeJitter(t *testing.T) {
+	// both beacons are 20s either side of their interval
+	fast := testGroup(100, []float64{40, 60, 80}, []int{256})
+	slow := testGroup(100, []float64{3580, 3600, 3620}, []int{256})
+
+	opts := defaultOptions()
+	opts.Jitter = "absolute"
+	fastScore, slowScore := scoreGroupedRecord(fast, opts), scoreGroupedRecord(slow, opts)
+	if fastScore.TSMadm != slowScore.TSMadm {
+		t.Errorf("absolute jitter: got fast madm %v and slow madm %v, want them equal", fastScore.TSMadm, slowScore.TSMadm)
+	}
+
+	opts.Jitter = "relative"
+	fastScore, slowScore = scoreGroupedRecord(fast, opts), scoreGroupedRecord(slow, opts)
+	if !(slowScore.TSMadm > fastScore.TSMadm && slowScore.TSScore > fastScore.TSScore) {
+		t.Errorf("relative jitter: got fast madm %v score %v, slow madm %v score %v, want the slow beacon higher",
+			fastScore.TSMadm, fastScore.TSScore, slowScore.TSMadm, slowScore.TSScore)
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	fileName := filepath.Join(b.TempDir(), "generated.csv")
+	generateDataset(fileName, 1)
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		b.Fatal(err)
+	}
+	pipelined := runtime.NumCPU()
+	if pipelined < 2 {
+		pipelined = 2
+	}
+	for _, workers := range []int{1, pipelined} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			opts := defaultOptions()
+			opts.ParseWorkers = workers
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				var stats ReadStats
+				readInputRecords(bytes.NewReader(data), opts, &stats)
+			}
+		})
+	}
+}
+
+func TestCommentAndLazyQuotes(t *testing.T) {
+	tests := []struct {
+		name          string
+		comment       string
+		lazy          bool
+		input         string
+		wantDsts      []string
+		wantMalformed int
+	}{
+		{
+			name:    "commented",
+			comment: "#",
+			input: "#fields ts src dst sent recv\n" +
+				"2023-03-02-00:00:00,10.0.0.5,evil.com,300,200\n" +
+				"#close 2023-03-02-00:02:00\n" +
+				"2023-03-02-00:01:00,10.0.0.5,evil.com,300,200\n",
+			wantDsts: []string{"evil.com", "evil.com"},
+		},
+		{
+			name: "quoted",
+			input: "2023-03-02-00:00:00,\"10.0.0.5\",\"evil.com/a,b\",300,200\n" +
+				"2023-03-02-00:01:00,10.0.0.5,\"say \"\"hi\"\"\",300,200\n",
+			wantDsts: []string{"evil.com/a,b", "say \"hi\""},
+		},
+		{
+			name: "stray quote",
+			input: "2023-03-02-00:00:00,10.0.0.5,evil.com,300,200\n" +
+				"2023-03-02-00:01:00,10.0.0.5,ev\"il.com,300,200\n",
+			wantDsts:      []string{"evil.com"},
+			wantMalformed: 1,
+		},
+		{
+			name: "stray quote lazy",
+			lazy: true,
+			input: "2023-03-02-00:00:00,10.0.0.5,evil.com,300,200\n" +
+				"2023-03-02-00:01:00,10.0.0.5,ev\"il.com,300,200\n",
+			wantDsts: []string{"evil.com", "ev\"il.com"},
+		},
+		{
+			name: "short rows lazy",
+			lazy: true,
+			input: "2023-03-02-00:00:00,10.0.0.5,evil.com,300,200,extra\n" +
+				"2023-03-02-00:01:00,10.0.0.5,evil.com\n" +
+				"2023-03-02-00:02:00,10.0.0.5,evil.com,300,200\n",
+			wantDsts: []string{"evil.com", "evil.com"},
+		},
+		{
+			name:    "commented and quoted lazy",
+			comment: "#",
+			lazy:    true,
+			input: "# exported \"by hand\"\n" +
+				"2023-03-02-00:00:00,10.0.0.5,\"evil.com\",300,200\n" +
+				"2023-03-02-00:01:00,10.0.0.5,evil.com\",300,200\n",
+			wantDsts: []string{"evil.com", "evil.com\""},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.Comment = test.comment
+			opts.LazyQuotes = test.lazy
+			var stats ReadStats
+			records, _, _ := readInputRecords(bytes.NewReader([]byte(test.input)), opts, &stats)
+			var dsts []string
+			for _, record := range records {
+				dsts = append(dsts, record.Dst)
+			}
+			if !reflect.DeepEqual(dsts, test.wantDsts) || stats.MalformedRows != test.wantMalformed {
+				t.Errorf("got %q with %d malformed rows, want %q with %d", dsts, stats.MalformedRows, test.wantDsts, test.wantMalformed)
+			}
+		})
+	}
+}
+
+func TestJA3ReplaceSkipsEmptyFingerprints(t *testing.T) {
+	opts := testOptions()
+	opts.ColumnJA3 = 5
+	opts.JA3Group = "replace"
+	start := time.Date(2023, 3, 2, 0, 0, 0, 0, time.UTC)
+	var records []Record
+	for i, ja3 := range []string{"e7d705a3286e19ea42f587b344ee6865", "", "-", "e7d705a3286e19ea42f587b344ee6865", ""} {
+		records = append(records, Record{Timestamp: start.Add(time.Duration(i) * time.Minute), Src: "10.0.0.5", Dst: fmt.Sprintf("203.0.113.%d", i), JA3: ja3})
+	}
+	groups, _ := groupInputRecords(records, opts, false, false)
+	if len(groups) != 1 || groups[0].Dst != "ja3:e7d705a3286e19ea42f587b344ee6865" || len(groups[0].Times) != 2 {
+		t.Errorf("got %d groups, want one ja3:e7d705a3286e19ea42f587b344ee6865 group of 2 connections", len(groups))
+	}
+}
+
+func TestFDROutboundOnly(t *testing.T) {
+	input := `{"event_simpleName":"NetworkConnectIP4","ComputerName":"host1","RemoteAddressIP4":"203.0.113.1","RemotePort":"443","ContextTimeStamp":"1677715200.000","ConnectionDirection":"0"}
+{"event_simpleName":"NetworkConnectIP4","ComputerName":"host1","RemoteAddressIP4":"203.0.113.2","RemotePort":"3389","ContextTimeStamp":"1677715260.000","ConnectionDirection":"1"}
+{"event_simpleName":"NetworkConnectIP4","ComputerName":"host1","RemoteAddressIP4":"203.0.113.3","RemotePort":"443","ContextTimeStamp":"1677715320.000","ConnectionDirection":2}
+{"event_simpleName":"NetworkConnectIP6","ComputerName":"host1","RemoteAddressIP6":"2001:db8::1","RemotePort":"443","ContextTimeStamp":"1677715380.000"}
+`
+	var stats ReadStats
+	records := readFDRRecords(bytes.NewReader([]byte(input)), &stats)
+	var dsts []string
+	for _, record := range records {
+		dsts = append(dsts, record.Dst)
+	}
+	if want := []string{"203.0.113.1", "2001:db8::1"}; !reflect.DeepEqual(dsts, want) || stats.SkippedRows != 2 {
+		t.Errorf("got %q with %d skipped rows, want %q with 2", dsts, stats.SkippedRows, want)
+	}
+}
+
+func TestPCAPBytesFromIPHeader(t *testing.T) {
+	// a raw ipv4 packet claiming 1500 bytes, captured with a snaplen of 40 so only the ip and tcp headers are there
+	packet := []byte{
+		0x45, 0, 0x05, 0xdc, 0, 0, 0x40, 0, 64, 6, 0, 0, 10, 0, 0, 5, 203, 0, 113, 1, // ip, total length 1500
+		0xc3, 0x50, 0x01, 0xbb, 0, 0, 0, 1, 0, 0, 0, 0, 0x50, tcpSyn, 0xff, 0xff, 0, 0, 0, 0, // tcp 50000 -> 443, SYN
+	}
+	tracker := newFlowTracker(time.Minute)
+	var stats ReadStats
+	tracker.addPacket(time.Unix(1677715200, 0), 101, packet, &stats)
+	records := tracker.finish()
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	if records[0].BytesSent != 1460 || records[0].Port != 443 {
+		t.Errorf("got %d bytes sent to port %d, want 1460 to 443", records[0].BytesSent, records[0].Port)
+	}
+}
+
+func TestRankScoredRecords(t *testing.T) {
+	var records []ScoredRecord
+	for _, score := range []float64{0.9, 0.9, 0.8, 0.7, 0.7, 0.7, 0.5, 0.1} {
+		records = append(records, ScoredRecord{Score: score})
+	}
+	rankScoredRecords(records)
+	want := []float64{100, 100, 75, 62.5, 62.5, 62.5, 25, 12.5}
+	for i, record := range records {
+		if record.Rank != want[i] {
+			t.Errorf("record %d with score %v: got rank %v, want %v", i, record.Score, record.Rank, want[i])
+		}
+	}
+
+	// every score tied is a single run
+	tied := make([]ScoredRecord, 100000)
+	rankScoredRecords(tied)
+	if tied[0].Rank != 100 || tied[len(tied)-1].Rank != 100 {
+		t.Errorf("got ranks %v and %v for tied scores, want 100", tied[0].Rank, tied[len(tied)-1].Rank)
+	}
+}
+
+func TestDetectIntervalModesUnsorted(t *testing.T) {
+	// a beacon alternating between 60s and 3600s sleeps, in the order they happened
+	var deltas []float64
+	for i := 0; i < 40; i++ {
+		if i%4 == 3 {
+			deltas = append(deltas, 3600+float64(i%3))
+		} else {
+			deltas = append(deltas, 60+float64(i%3))
+		}
+	}
+	unsorted := append([]float64(nil), deltas...)
+	modes := detectIntervalModes(deltas, defaultOptions())
+	if len(modes) != 2 || modes[0].Interval != 61 || modes[1].Interval != 3601 {
+		t.Errorf("got modes %+v, want 61s and 3601s", modes)
+	}
+	if !reflect.DeepEqual(deltas, unsorted) {
+		t.Error("the deltas passed in were reordered")
+	}
+}
+
+func TestBrowseResultsStartsSortedByScore(t *testing.T) {
+	// -by-src order, the sources' records together
+	records := []ScoredRecord{
+		{Src: "10.0.0.5", Dst: "a.example.com", Score: 0.6},
+		{Src: "10.0.0.5", Dst: "b.example.com", Score: 0.55},
+		{Src: "10.0.0.6", Dst: "c.example.com", Score: 0.95},
+	}
+	var out bytes.Buffer
+	browseResults(records, defaultOptions(), false, false, strings.NewReader("q\n"), &out)
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) < 2 || !strings.Contains(lines[1], "10.0.0.6") {
+		t.Errorf("got first row %q, want the highest score", lines[1])
+	}
+}
+
+func TestSuricataRule(t *testing.T) {
+	tests := []struct {
+		name   string
+		target ruleTarget
+		want   string
+	}{
+		{"udp address", ruleTarget{dst: "203.0.113.1", kind: "ipv4-addr", port: 53, proto: "udp"}, "alert udp $HOME_NET any -> 203.0.113.1 53 ("},
+		{"tcp address", ruleTarget{dst: "203.0.113.1", kind: "ipv4-addr", port: 8080, proto: "tcp"}, "alert tcp $HOME_NET any -> 203.0.113.1 8080 ("},
+		{"address without protocol", ruleTarget{dst: "203.0.113.1", kind: "ipv4-addr", port: 8080}, "alert ip $HOME_NET any -> 203.0.113.1 any ("},
+		{"https url", ruleTarget{dst: "https://evil.com/beacon", kind: "url", port: 443}, `alert tls $HOME_NET any -> $EXTERNAL_NET 443 (msg:"beacon_finder beacon to https://evil.com/beacon"; tls.sni; content:"evil.com"; nocase; bsize:8;`},
+		{"https url without port", ruleTarget{dst: "https://evil.com/beacon", kind: "url"}, `-> $EXTERNAL_NET any (msg:"beacon_finder beacon to https://evil.com/beacon"; tls.sni; content:"evil.com";`},
+		{"http url", ruleTarget{dst: "http://evil.com/beacon", kind: "url", port: 80}, `http.host; content:"evil.com"; nocase; bsize:8; http.uri; content:"/beacon"; startswith;`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if rule := suricataRule(&test.target, defaultOptions(), 9100001); !strings.Contains(rule, test.want) {
+				t.Errorf("got rule %q, want it to contain %q", rule, test.want)
+			}
+		})
+	}
+}
+
+func TestGroupProto(t *testing.T) {
+	start := time.Date(2023, 3, 2, 0, 0, 0, 0, time.UTC)
+	records := []Record{
+		{Timestamp: start, Src: "10.0.0.5", Dst: "203.0.113.1", Port: 53, Proto: "udp"},
+		{Timestamp: start.Add(time.Minute), Src: "10.0.0.5", Dst: "203.0.113.1", Port: 53, Proto: "udp"},
+		{Timestamp: start, Src: "10.0.0.6", Dst: "203.0.113.1", Port: 53, Proto: "udp"},
+		{Timestamp: start.Add(time.Minute), Src: "10.0.0.6", Dst: "203.0.113.1", Port: 53, Proto: "tcp"},
+	}
+	for _, group := range groupRecords(records, true, false, false) {
+		want := map[string]string{"10.0.0.5": "udp", "10.0.0.6": ""}[group.Src]
+		if group.Proto != want {
+			t.Errorf("%s: got protocol %q, want %q", group.Src, group.Proto, want)
+		}
+	}
+}
+
+func TestApplyConfigLargeNumbers(t *testing.T) {
+	defaultOptions() // registers the flags
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configFile, []byte(`{"m": 1000000, "tJ": 0.25}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer flag.Set("m", "36")
+	defer flag.Set("tJ", "0.2")
+	if err := applyConfig(configFile); err != nil {
+		t.Fatal(err)
+	}
+	if m, tJ := flag.Lookup("m").Value.String(), flag.Lookup("tJ").Value.String(); m != "1000000" || tJ != "0.25" {
+		t.Errorf("got -m %s and -tJ %s, want 1000000 and 0.25", m, tJ)
+	}
+}
+
+func TestJSONDetectsTimeFormatPastSample(t *testing.T) {
+	opts := testOptions()
+	opts.TimeFormat = "auto"
+	opts.FieldTime, opts.FieldSource, opts.FieldDest, opts.FieldByteSent, opts.FieldByteRecv = "ts", "src", "dst", "out", "in"
+	var input strings.Builder
+	rows := timeSampleRows*2 + 5
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&input, `{"ts": %d, "src": "10.0.0.1", "dst": "c.example.com", "out": 100, "in": 200}`+"\n", 1700000000+i*60)
+	}
+	var stats ReadStats
+	records := readJSONRecords(strings.NewReader(input.String()), opts, &stats)
+	if len(records) != rows || stats.SkippedRows != 0 {
+		t.Fatalf("got %d records and %d skipped rows, want %d and 0", len(records), stats.SkippedRows, rows)
+	}
+	for i, record := range records {
+		if want := time.Unix(int64(1700000000+i*60), 0); !record.Timestamp.Equal(want) {
+			t.Fatalf("record %d at %v, want %v", i, record.Timestamp, want)
+		}
+	}
+}
+
+func TestEVEHTTPSizesFromFlows(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	var input strings.Builder
+	start := time.Date(2023, 3, 2, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 30; i++ {
+		at := start.Add(time.Duration(i) * time.Minute).Format("2006-01-02T15:04:05.000000-0700")
+		flowID := 1000 + i
+		fmt.Fprintf(&input, `{"timestamp":%q,"flow_id":%d,"event_type":"http","src_ip":"10.0.0.5","dest_ip":"203.0.113.1","dest_port":80,"proto":"TCP","http":{"hostname":"c.example.com","http_method":"POST","length":512}}`+"\n", at, flowID)
+		fmt.Fprintf(&input, `{"timestamp":%q,"flow_id":%d,"event_type":"flow","src_ip":"10.0.0.5","dest_ip":"203.0.113.1","dest_port":80,"proto":"TCP","flow":{"start":%q,"bytes_toserver":%d,"bytes_toclient":%d}}`+"\n", at, flowID, at, 300+random.Intn(20000), 600+random.Intn(20000))
+	}
+	var stats ReadStats
+	records, hasMethod := readEVERecords(strings.NewReader(input.String()), &stats)
+	if len(records) != 30 || stats.SkippedRows != 30 {
+		t.Fatalf("got %d records and %d skipped rows, want 30 and 30 (the joined flows)", len(records), stats.SkippedRows)
+	}
+	groupedRecords, isPort := groupInputRecords(records, testOptions(), true, hasMethod)
+	if len(groupedRecords) != 1 {
+		t.Fatalf("got %d groups, want 1", len(groupedRecords))
+	}
+	opts := testOptions()
+	scored := scoreGroupedRecord(groupedRecords[0], opts)
+	if !isPort || scored.Dst != "c.example.com" {
+		t.Errorf("got %s with ports %v, want c.example.com with ports", scored.Dst, isPort)
+	}
+	if scored.DSScore > 0.8 {
+		t.Errorf("got a data score of %.3f for requests of varied sizes, want it well below 1", scored.DSScore)
+	}
+}
+
+func TestBurstsLowerBurstyScore(t *testing.T) {
+	// bursts of 2-5 requests logged 1s apart, with irregular gaps between them
+	random := rand.New(rand.NewSource(1))
+	group := GroupedRecord{Src: "10.0.0.5", Dst: "sync.example.com"}
+	timestamp := time.Date(2023, 3, 2, 0, 0, 0, 0, time.UTC)
+	for burst := 0; burst < 40; burst++ {
+		timestamp = timestamp.Add(time.Duration(300+random.Intn(3300)) * time.Second)
+		for i := 0; i < 2+random.Intn(4); i++ {
+			group.Times = append(group.Times, timestamp.Add(time.Duration(i)*time.Second))
+			group.SentSizes = append(group.SentSizes, 700)
+			group.ReceivedSizes = append(group.ReceivedSizes, 400)
+		}
+	}
+
+	opts := testOptions()
+	keep := scoreGroupedRecord(group, opts).Score
+	merge := scoreGroupedRecord(mergeBursts(group, opts.BurstWindow), opts).Score
+	opts.Bursts = "exclude"
+	exclude := scoreGroupedRecord(group, opts).Score
+	t.Logf("keep %.3f, merge %.3f, exclude %.3f", keep, merge, exclude)
+	if merge >= keep-0.1 || exclude >= keep-0.1 {
+		t.Errorf("got keep %.3f, merge %.3f and exclude %.3f, want merge and exclude well below keep", keep, merge, exclude)
+	}
+}
+
+func TestFieldsSkipsRowsWithUnquotedDelimiter(t *testing.T) {
+	// -fields is read through isFlagPassed, so it's set on a flag set of its own
+	commandLine := flag.CommandLine
+	defer func() { flag.CommandLine = commandLine }()
+	flag.CommandLine = flag.NewFlagSet("beacon_finder", flag.ContinueOnError)
+	flag.Int("fields", 0, "")
+	if err := flag.Set("fields", "5"); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testOptions()
+	opts.FieldsPerRecord = 5
+	opts.LazyQuotes = true // allows any number of fields without -fields
+	input := "2023-03-02-00:00:00,10.0.0.5,evil.com/poll,300,200\n" +
+		"2023-03-02-00:01:00,10.0.0.5,evil.com/poll?a=1,2,300,200\n" +
+		"2023-03-02-00:02:00,10.0.0.5,evil.com/poll,310,210\n"
+	var stats ReadStats
+	records := readCSVRecords(strings.NewReader(input), opts, &stats)
+	if stats.MalformedRows != 1 || stats.SkippedRows != 1 {
+		t.Errorf("got %d malformed and %d skipped rows, want 1 and 1", stats.MalformedRows, stats.SkippedRows)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	for i, want := range []Record{{Dst: "evil.com/poll", BytesSent: 300, BytesReceived: 200}, {Dst: "evil.com/poll", BytesSent: 310, BytesReceived: 210}} {
+		if got := records[i]; got.Src != "10.0.0.5" || got.Dst != want.Dst || got.BytesSent != want.BytesSent || got.BytesReceived != want.BytesReceived {
+			t.Errorf("record %d is %s -> %s sent %d received %d, want 10.0.0.5 -> %s sent %d received %d", i, got.Src, got.Dst, got.BytesSent, got.BytesReceived, want.Dst, want.BytesSent, want.BytesReceived)
+		}
+	}
+}
+
+func TestSentAndReceivedMadmMatch(t *testing.T) {
+	opts := testOptions()
+	opts.Wide = true
+	constant := scoreGroupedRecord(testGroup(40, []float64{60}, []int{100}), opts)
+	if constant.DSMadm != 1 || constant.RSMadm != 1 {
+		t.Errorf("got dsMadm %.3f and rsMadm %.3f for constant sizes, want 1 and 1", constant.DSMadm, constant.RSMadm)
+	}
+
+	// the same sizes sent and received score the same on both sides
+	group := testGroup(40, []float64{60}, []int{100, 140, 180, 120})
+	copy(group.ReceivedSizes, group.SentSizes)
+	varied := scoreGroupedRecord(group, opts)
+	if varied.DSMadm != varied.RSMadm {
+		t.Errorf("got dsMadm %.3f and rsMadm %.3f for the same sizes, want them equal", varied.DSMadm, varied.RSMadm)
+	}
+}
+
+func TestHeaderKeepsPassedColumns(t *testing.T) {
+	opts := testOptions()
+	opts.ColumnSource = 3
+	opts.columnsPassed = map[string]bool{"cS": true}
+	names := []string{"ts", "uid", "id.orig_h", "id.orig_p", "id.resp_h", "id.resp_p", "proto", "service", "duration", "orig_bytes", "resp_bytes"}
+	opts = mapHeaderColumns(names, opts, inputProfiles["zeek-conn"].HeaderCols)
+	if opts.ColumnSource != 3 {
+		t.Errorf("got -cS %d, want the passed 3", opts.ColumnSource)
+	}
+	if opts.ColumnTime != 0 || opts.ColumnDest != 4 || opts.ColumnPort != 5 || opts.ColumnByteSent != 9 || opts.ColumnByteRecv != 10 {
+		t.Errorf("got -cT %d -cD %d -cP %d -cX %d -cR %d, want 0 4 5 9 10 from the header", opts.ColumnTime, opts.ColumnDest, opts.ColumnPort, opts.ColumnByteSent, opts.ColumnByteRecv)
+	}
+}
+
+func TestZstdInputReapedOnEarlyClose(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("no zstd command")
+	}
+	fileName := filepath.Join(t.TempDir(), "input.csv")
+	if err := os.WriteFile(fileName, bytes.Repeat([]byte("2023-03-02-00:00:00,10.0.0.5,evil.com,300,200\n"), 100000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("zstd", "-q", "--rm", fileName).CombinedOutput(); err != nil {
+		t.Fatalf("zstd: %v %s", err, out)
+	}
+
+	input, err := openDecompressed(fileName + ".zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := input.Read(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := input.Close(); err != nil {
+		t.Errorf("got %v closing early, want nil", err)
+	}
+	zstd := input.Reader.(*zstdReader)
+	if zstd.cmd.ProcessState == nil {
+		t.Error("zstd wasn't reaped")
+	}
+}
+
+func TestStixAddress(t *testing.T) {
+	tests := []struct {
+		value     string
+		wantType  string
+		wantValue string
+	}{
+		{"203.0.113.1", "ipv4-addr", "203.0.113.1"},
+		{"2001:db8::1", "ipv6-addr", "2001:db8::1"},
+		{"c.example.com", "domain-name", "c.example.com"},
+		{"https://c.example.com/poll", "url", "https://c.example.com/poll"},
+		{"c.example.com/poll", "domain-name", "c.example.com"},
+		{"203.0.113.1/poll", "ipv4-addr", "203.0.113.1"},
+		{"c.example.com:8080/poll", "domain-name", "c.example.com"},
+		{"/api/poll", "", ""},
+		{"ja3:e7d705a3286e19ea42f587b344ee6865", "", ""},
+		{"workstation", "", ""},
+	}
+	for _, test := range tests {
+		observable, ok := stixAddress(test.value)
+		if ok != (test.wantType != "") || observable.Type != test.wantType || observable.Value != test.wantValue {
+			t.Errorf("stixAddress(%q) = %s %q, %v, want %s %q", test.value, observable.Type, observable.Value, ok, test.wantType, test.wantValue)
+		}
+	}
+}